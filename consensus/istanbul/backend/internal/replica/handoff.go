@@ -0,0 +1,363 @@
+// Copyright 2020 The Celo Authors
+// This file is part of the celo library.
+//
+// The celo library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The celo library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the celo library. If not, see <http://www.gnu.org/licenses/>.
+
+package replica
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// DefaultHandoffDeadlineBlocks is the number of blocks, counted from a
+// requested handoff's target block, that a primary will wait for a
+// readiness attestation before falling back to unilaterally stopping at
+// the target block regardless of whether a standby took over.
+const DefaultHandoffDeadlineBlocks = 10
+
+// Handoff message codes, identifying the payload carried by a
+// SignedHandoffMessage.
+const (
+	HandoffRequestCode     uint8 = 1
+	HandoffAttestationCode uint8 = 2
+)
+
+// HandoffTransport is the dependency the istanbul backend provides so the
+// replica package can sign and gossip handoff messages over the existing
+// p2p/istanbul transport without importing it directly. It is wired in via
+// SetHandoffTransport once the backend itself has been constructed.
+type HandoffTransport interface {
+	// Self is the signing address this node identifies itself as.
+	Self() common.Address
+	// Sign signs hash with this node's validator key.
+	Sign(hash []byte) ([]byte, error)
+	// Gossip sends payload to the peer identified by target.
+	Gossip(target enode.ID, payload []byte) error
+	// IsAuthorizedPeer reports whether address is the validator address the
+	// backend expects to be talking to at peer, e.g. because address is in
+	// the current validator set and is the address peer authenticated as at
+	// the p2p layer. It is consulted before acting on any inbound handoff
+	// message: a self-consistent signature only proves the sender controls
+	// the private key for its claimed address, not that the address is an
+	// authorized counterparty for this handoff.
+	IsAuthorizedPeer(address common.Address, peer enode.ID) bool
+}
+
+// HandoffRequestPayload is the signed payload a primary sends to announce
+// its intent to hand off at AtBlock.
+type HandoffRequestPayload struct {
+	AtBlock *big.Int
+}
+
+// HandoffAttestationPayload is the signed payload a candidate replica sends
+// back in reply to a HandoffRequestPayload, reporting its current head.
+type HandoffAttestationPayload struct {
+	AtBlock *big.Int
+	Head    *big.Int
+}
+
+// SignedHandoffMessage is the wire format for both handoff requests and
+// attestations: a typed, RLP-encoded payload plus the sender's address and
+// signature over it.
+type SignedHandoffMessage struct {
+	Code      uint8
+	Payload   rlp.RawValue
+	Address   common.Address
+	Signature []byte
+}
+
+// sigHash is the hash signed over and verified for a handoff message; it
+// deliberately excludes Address/Signature themselves.
+func (m *SignedHandoffMessage) sigHash() common.Hash {
+	data, _ := rlp.EncodeToBytes([]interface{}{m.Code, m.Payload})
+	return crypto.Keccak256Hash(data)
+}
+
+// Sign fills in Address and Signature using transport's signing key.
+func (m *SignedHandoffMessage) Sign(transport HandoffTransport) error {
+	m.Address = transport.Self()
+	sig, err := transport.Sign(m.sigHash().Bytes())
+	if err != nil {
+		return err
+	}
+	m.Signature = sig
+	return nil
+}
+
+// VerifySignature checks that Signature is a valid signature by Address
+// over this message's contents.
+func (m *SignedHandoffMessage) VerifySignature() error {
+	pubkey, err := crypto.SigToPub(m.sigHash().Bytes(), m.Signature)
+	if err != nil {
+		return fmt.Errorf("recovering handoff message signer: %w", err)
+	}
+	if addr := crypto.PubkeyToAddress(*pubkey); addr != m.Address {
+		return fmt.Errorf("handoff message signature does not match claimed sender %v", m.Address)
+	}
+	return nil
+}
+
+// newSignedHandoffMessage RLP-encodes payload and signs the result with
+// transport's key.
+func newSignedHandoffMessage(transport HandoffTransport, code uint8, payload interface{}) ([]byte, error) {
+	encodedPayload, err := rlp.EncodeToBytes(payload)
+	if err != nil {
+		return nil, err
+	}
+	msg := &SignedHandoffMessage{Code: code, Payload: encodedPayload}
+	if err := msg.Sign(transport); err != nil {
+		return nil, err
+	}
+	return rlp.EncodeToBytes(msg)
+}
+
+// PendingHandoff records an in-flight primary<->replica handoff
+// negotiation. It is stored on both sides of the handoff: the primary
+// that requested it and the candidate replica that is expected to accept
+// it, distinguished by the node's own isReplica flag.
+type PendingHandoff struct {
+	Peer     enode.ID // the counterparty: the candidate on the primary, the primary on the candidate
+	AtBlock  *big.Int
+	Deadline *big.Int
+}
+
+// SetHandoffTransport wires up the istanbul backend's signing key and p2p
+// gossip so RequestHandoff/AcceptHandoff can exchange signed messages with
+// the peer on the other end of a handoff. It must be called once, after
+// both the replica State and the backend have been constructed.
+func (rs *replicaStateImpl) SetHandoffTransport(transport HandoffTransport) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.transport = transport
+}
+
+// RequestHandoff announces this primary's intent to hand off validating
+// duties to the given candidate replica at atBlock, by signing and
+// gossiping a HandoffRequestPayload to target over HandoffTransport. It
+// does not itself stop validating: SetStopValidatingBlock is only
+// committed once the candidate's readiness attestation is accepted via
+// AcceptHandoff, or the deadline passes without one (see
+// TickHandoffDeadline).
+func (rs *replicaStateImpl) RequestHandoff(target enode.ID, atBlock *big.Int) error {
+	rs.mu.Lock()
+	if rs.isReplica {
+		rs.mu.Unlock()
+		return errors.New("a replica cannot request a handoff")
+	}
+	if atBlock == nil {
+		rs.mu.Unlock()
+		return errors.New("atBlock must be set")
+	}
+
+	rs.pendingHandoff = &PendingHandoff{
+		Peer:     target,
+		AtBlock:  atBlock,
+		Deadline: new(big.Int).Add(atBlock, big.NewInt(DefaultHandoffDeadlineBlocks)),
+	}
+	rs.rsdb.StoreReplicaState(rs)
+	transport := rs.transport
+	rs.mu.Unlock()
+
+	// Signing and gossiping are unbounded network calls; they must happen
+	// after rs.mu is released so a slow peer can't stall every other
+	// caller, including ShouldStartCore/ShouldStopCore on the per-block
+	// hot path.
+	if transport == nil {
+		return nil
+	}
+	raw, err := newSignedHandoffMessage(transport, HandoffRequestCode, HandoffRequestPayload{AtBlock: atBlock})
+	if err != nil {
+		return fmt.Errorf("signing handoff request: %w", err)
+	}
+	if err := transport.Gossip(target, raw); err != nil {
+		log.Warn("Failed to gossip handoff request", "target", target, "atBlock", atBlock, "err", err)
+	}
+	return nil
+}
+
+// AcceptHandoff is called with an already-authenticated handoff message
+// from peer, i.e. one that has already passed authorizeHandoffSender, and
+// completes whichever side of the handoff this node is playing:
+//
+//   - On the candidate replica, peer is the primary requesting the
+//     handoff. If this node's head has reached atBlock, it commits
+//     SetStartValidatingBlock(atBlock) so it is ready to take over. A
+//     pending handoff already in flight with a different peer is left
+//     untouched rather than overwritten, so an authorized-but-unrelated
+//     validator can't hijack a handoff it wasn't a party to.
+//   - On the primary, peer is the candidate replying with its readiness
+//     attestation. If it matches the pending handoff and the candidate's
+//     head has reached atBlock, the primary commits
+//     SetStopValidatingBlock(atBlock) and clears the pending handoff.
+//
+// In both cases head is the reported chain head of the attesting party.
+func (rs *replicaStateImpl) AcceptHandoff(peer enode.ID, atBlock *big.Int, head *big.Int) error {
+	rs.mu.Lock()
+
+	if atBlock == nil || head == nil {
+		rs.mu.Unlock()
+		return errors.New("atBlock and head must be set")
+	}
+	if head.Cmp(atBlock) < 0 {
+		rs.mu.Unlock()
+		return fmt.Errorf("peer %v is not caught up to handoff block %s: head is %s", peer, atBlock, head)
+	}
+
+	if rs.isReplica {
+		if rs.pendingHandoff != nil && rs.pendingHandoff.Peer != peer {
+			rs.mu.Unlock()
+			return fmt.Errorf("already have a pending handoff with %v, ignoring request from %v", rs.pendingHandoff.Peer, peer)
+		}
+		rs.pendingHandoff = &PendingHandoff{Peer: peer, AtBlock: atBlock}
+		if err := rs.setStartValidatingBlockLocked(atBlock); err != nil {
+			rs.mu.Unlock()
+			return err
+		}
+		rs.rsdb.StoreReplicaState(rs)
+		summary := rs.summaryLocked()
+		transport := rs.transport
+		rs.mu.Unlock()
+
+		rs.feed.Send(*summary)
+		if transport == nil {
+			return nil
+		}
+		raw, err := newSignedHandoffMessage(transport, HandoffAttestationCode, HandoffAttestationPayload{AtBlock: atBlock, Head: head})
+		if err != nil {
+			return fmt.Errorf("signing handoff attestation: %w", err)
+		}
+		if err := transport.Gossip(peer, raw); err != nil {
+			log.Warn("Failed to gossip handoff attestation", "primary", peer, "atBlock", atBlock, "err", err)
+		}
+		return nil
+	}
+
+	if rs.pendingHandoff == nil || rs.pendingHandoff.Peer != peer || rs.pendingHandoff.AtBlock.Cmp(atBlock) != 0 {
+		rs.mu.Unlock()
+		return fmt.Errorf("no pending handoff to %v at block %s", peer, atBlock)
+	}
+	if err := rs.setStopValidatingBlockLocked(atBlock); err != nil {
+		rs.mu.Unlock()
+		return err
+	}
+	rs.pendingHandoff = nil
+	rs.rsdb.StoreReplicaState(rs)
+	summary := rs.summaryLocked()
+	rs.mu.Unlock()
+
+	rs.feed.Send(*summary)
+	return nil
+}
+
+// HandleHandoffMessage verifies and dispatches an inbound SignedHandoffMessage
+// gossiped by sender over the istanbul transport: a HandoffRequestCode
+// message is a primary inviting this node (assumed caught up to localHead)
+// to take over, and a HandoffAttestationCode message is a candidate's
+// readiness reply to a handoff this node requested. It is the call site
+// the istanbul backend invokes when it receives a handoff message from the
+// p2p layer.
+func (rs *replicaStateImpl) HandleHandoffMessage(sender enode.ID, raw []byte, localHead *big.Int) error {
+	var msg SignedHandoffMessage
+	if err := rlp.DecodeBytes(raw, &msg); err != nil {
+		return fmt.Errorf("decoding handoff message: %w", err)
+	}
+	if err := msg.VerifySignature(); err != nil {
+		return err
+	}
+	if err := rs.authorizeHandoffSender(msg.Address, sender); err != nil {
+		return err
+	}
+
+	switch msg.Code {
+	case HandoffRequestCode:
+		var payload HandoffRequestPayload
+		if err := rlp.DecodeBytes(msg.Payload, &payload); err != nil {
+			return fmt.Errorf("decoding handoff request payload: %w", err)
+		}
+		return rs.AcceptHandoff(sender, payload.AtBlock, localHead)
+	case HandoffAttestationCode:
+		var payload HandoffAttestationPayload
+		if err := rlp.DecodeBytes(msg.Payload, &payload); err != nil {
+			return fmt.Errorf("decoding handoff attestation payload: %w", err)
+		}
+		return rs.AcceptHandoff(sender, payload.AtBlock, payload.Head)
+	default:
+		return fmt.Errorf("unknown handoff message code %d", msg.Code)
+	}
+}
+
+// authorizeHandoffSender checks address, the claimed signer of a handoff
+// message gossiped by peer, against HandoffTransport.IsAuthorizedPeer. A
+// valid signature over a message only proves self-consistency between
+// Address and Signature, not that address is who this node should be
+// taking handoff instructions from; every inbound message must pass this
+// check before AcceptHandoff is allowed to act on it.
+func (rs *replicaStateImpl) authorizeHandoffSender(address common.Address, peer enode.ID) error {
+	rs.mu.RLock()
+	transport := rs.transport
+	rs.mu.RUnlock()
+
+	if transport == nil || !transport.IsAuthorizedPeer(address, peer) {
+		return fmt.Errorf("rejecting handoff message from %v: %v is not an authorized counterparty", peer, address)
+	}
+	return nil
+}
+
+// TickHandoffDeadline is called by the backend on every new block seq. If
+// a pending handoff's deadline has passed without AcceptHandoff having
+// been called, it falls back to the current unilateral behavior: the
+// primary commits SetStopValidatingBlock(atBlock) on its own rather than
+// waiting indefinitely for a standby that may never come online.
+func (rs *replicaStateImpl) TickHandoffDeadline(seq *big.Int) {
+	rs.mu.Lock()
+
+	if rs.pendingHandoff == nil || rs.isReplica || seq.Cmp(rs.pendingHandoff.Deadline) < 0 {
+		rs.mu.Unlock()
+		return
+	}
+
+	atBlock, peer := rs.pendingHandoff.AtBlock, rs.pendingHandoff.Peer
+	if err := rs.setStopValidatingBlockLocked(atBlock); err != nil {
+		rs.mu.Unlock()
+		log.Error("Failed to fall back to unilateral handoff after deadline", "atBlock", atBlock, "peer", peer, "err", err)
+		return
+	}
+	rs.pendingHandoff = nil
+	rs.rsdb.StoreReplicaState(rs)
+	summary := rs.summaryLocked()
+	rs.mu.Unlock()
+
+	rs.feed.Send(*summary)
+}
+
+// PendingHandoff returns the currently pending handoff negotiation, or nil
+// if there isn't one.
+func (rs *replicaStateImpl) PendingHandoff() *PendingHandoff {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	if rs.pendingHandoff == nil {
+		return nil
+	}
+	handoff := *rs.pendingHandoff
+	return &handoff
+}
@@ -0,0 +1,235 @@
+// Copyright 2020 The Celo Authors
+// This file is part of the celo library.
+//
+// The celo library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The celo library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the celo library. If not, see <http://www.gnu.org/licenses/>.
+
+package replica
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// fakeHandoffTransport is a minimal HandoffTransport for tests. authorized
+// records the (peer, address) pairs IsAuthorizedPeer should accept, mimicking
+// the backend's real validator-set/peer-identity check.
+type fakeHandoffTransport struct {
+	key        *ecdsa.PrivateKey
+	self       common.Address
+	authorized map[enode.ID]common.Address
+}
+
+func newFakeHandoffTransport(t *testing.T) *fakeHandoffTransport {
+	t.Helper()
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return &fakeHandoffTransport{
+		key:        key,
+		self:       crypto.PubkeyToAddress(key.PublicKey),
+		authorized: make(map[enode.ID]common.Address),
+	}
+}
+
+func (f *fakeHandoffTransport) Self() common.Address { return f.self }
+
+func (f *fakeHandoffTransport) Sign(hash []byte) ([]byte, error) {
+	return crypto.Sign(hash, f.key)
+}
+
+func (f *fakeHandoffTransport) Gossip(target enode.ID, payload []byte) error {
+	return nil
+}
+
+func (f *fakeHandoffTransport) IsAuthorizedPeer(address common.Address, peer enode.ID) bool {
+	return f.authorized[peer] == address
+}
+
+// newTestReplicaState opens a fresh ReplicaStateDB under t.TempDir() so
+// tests can exercise mutating paths (which persist via rs.rsdb) the same
+// way NewState does in production.
+func newTestReplicaState(t *testing.T, isReplica bool) *replicaStateImpl {
+	t.Helper()
+	db, err := OpenReplicaStateDB(t.TempDir())
+	if err != nil {
+		t.Fatalf("OpenReplicaStateDB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return &replicaStateImpl{
+		isReplica: isReplica,
+		mu:        new(sync.RWMutex),
+		rsdb:      db,
+	}
+}
+
+// TestSignedHandoffMessageRoundTrip checks that a message signed with
+// newSignedHandoffMessage decodes, verifies, and carries its payload
+// intact.
+func TestSignedHandoffMessageRoundTrip(t *testing.T) {
+	transport := newFakeHandoffTransport(t)
+	raw, err := newSignedHandoffMessage(transport, HandoffRequestCode, HandoffRequestPayload{AtBlock: big.NewInt(42)})
+	if err != nil {
+		t.Fatalf("newSignedHandoffMessage: %v", err)
+	}
+
+	var msg SignedHandoffMessage
+	if err := rlp.DecodeBytes(raw, &msg); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if err := msg.VerifySignature(); err != nil {
+		t.Fatalf("VerifySignature: %v", err)
+	}
+	if msg.Address != transport.Self() {
+		t.Fatalf("unexpected signer address: got %v, want %v", msg.Address, transport.Self())
+	}
+
+	var payload HandoffRequestPayload
+	if err := rlp.DecodeBytes(msg.Payload, &payload); err != nil {
+		t.Fatalf("decode payload: %v", err)
+	}
+	if payload.AtBlock.Cmp(big.NewInt(42)) != 0 {
+		t.Fatalf("unexpected AtBlock: %v", payload.AtBlock)
+	}
+}
+
+// TestSignedHandoffMessageVerifyRejectsTamperedAddress checks that
+// VerifySignature only accepts a claimed Address that is actually the
+// signer's: it must not be possible to relabel a genuine signature as
+// having come from a different address.
+func TestSignedHandoffMessageVerifyRejectsTamperedAddress(t *testing.T) {
+	transport := newFakeHandoffTransport(t)
+	raw, err := newSignedHandoffMessage(transport, HandoffRequestCode, HandoffRequestPayload{AtBlock: big.NewInt(1)})
+	if err != nil {
+		t.Fatalf("newSignedHandoffMessage: %v", err)
+	}
+	var msg SignedHandoffMessage
+	if err := rlp.DecodeBytes(raw, &msg); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	msg.Address = common.Address{0xff}
+	if err := msg.VerifySignature(); err == nil {
+		t.Fatalf("expected VerifySignature to reject a claimed address that does not match the signature")
+	}
+}
+
+// TestHandleHandoffMessageRejectsUnauthorizedSender checks that a
+// self-consistently signed message from a key that isn't the configured
+// counterparty's is rejected before AcceptHandoff ever runs: a
+// self-consistent signature alone must not be treated as authorization.
+func TestHandleHandoffMessageRejectsUnauthorizedSender(t *testing.T) {
+	attacker := newFakeHandoffTransport(t)
+	peer := enode.ID{0x01}
+
+	rs := newTestReplicaState(t, true)
+	rs.transport = attacker // attacker is never added to its own authorized set
+
+	raw, err := newSignedHandoffMessage(attacker, HandoffRequestCode, HandoffRequestPayload{AtBlock: big.NewInt(10)})
+	if err != nil {
+		t.Fatalf("newSignedHandoffMessage: %v", err)
+	}
+
+	if err := rs.HandleHandoffMessage(peer, raw, big.NewInt(10)); err == nil {
+		t.Fatalf("expected HandleHandoffMessage to reject a message from an unauthorized sender")
+	}
+	if rs.pendingHandoff != nil {
+		t.Fatalf("unauthorized message must not create a pending handoff, got %+v", rs.pendingHandoff)
+	}
+}
+
+// TestAcceptHandoffReplicaRejectsHijackOfPendingHandoff checks that once a
+// replica has a pending handoff with one peer, a request claiming to be
+// from a different (even authorized) peer does not overwrite it.
+func TestAcceptHandoffReplicaRejectsHijackOfPendingHandoff(t *testing.T) {
+	rs := newTestReplicaState(t, true)
+	primary := enode.ID{0x01}
+	impostor := enode.ID{0x02}
+	rs.pendingHandoff = &PendingHandoff{Peer: primary, AtBlock: big.NewInt(10)}
+
+	if err := rs.AcceptHandoff(impostor, big.NewInt(20), big.NewInt(20)); err == nil {
+		t.Fatalf("expected AcceptHandoff to reject a handoff from a different peer while one is already pending")
+	}
+	if rs.pendingHandoff.Peer != primary || rs.pendingHandoff.AtBlock.Cmp(big.NewInt(10)) != 0 {
+		t.Fatalf("pending handoff was overwritten by an unrelated request: %+v", rs.pendingHandoff)
+	}
+}
+
+// TestAcceptHandoffPrimaryRejectsMismatchedAttestation checks that a
+// primary only commits SetStopValidatingBlock for an attestation that
+// matches the handoff it actually requested.
+func TestAcceptHandoffPrimaryRejectsMismatchedAttestation(t *testing.T) {
+	rs := newTestReplicaState(t, false)
+	candidate := enode.ID{0x01}
+	other := enode.ID{0x02}
+	rs.pendingHandoff = &PendingHandoff{Peer: candidate, AtBlock: big.NewInt(10)}
+
+	if err := rs.AcceptHandoff(other, big.NewInt(10), big.NewInt(10)); err == nil {
+		t.Fatalf("expected AcceptHandoff to reject an attestation from a peer other than the pending handoff's")
+	}
+	if err := rs.AcceptHandoff(candidate, big.NewInt(11), big.NewInt(11)); err == nil {
+		t.Fatalf("expected AcceptHandoff to reject an attestation at a block other than the pending handoff's")
+	}
+	if rs.pendingHandoff == nil {
+		t.Fatalf("a rejected attestation must not clear the pending handoff")
+	}
+}
+
+// TestTickHandoffDeadlineFallsBack checks that once a pending handoff's
+// deadline has passed without a matching attestation, the primary falls
+// back to unilaterally stopping at the handoff's target block and clears
+// the pending handoff, notifying SubscribeStateChange subscribers.
+func TestTickHandoffDeadlineFallsBack(t *testing.T) {
+	rs := newTestReplicaState(t, false)
+	peer := enode.ID{0x01}
+	rs.pendingHandoff = &PendingHandoff{
+		Peer:     peer,
+		AtBlock:  big.NewInt(100),
+		Deadline: big.NewInt(110),
+	}
+
+	ch := make(chan ReplicaStateSummary, 1)
+	sub := rs.SubscribeStateChange(ch)
+	defer sub.Unsubscribe()
+
+	rs.TickHandoffDeadline(big.NewInt(109))
+	if rs.pendingHandoff == nil {
+		t.Fatalf("deadline has not passed yet, pending handoff should still be set")
+	}
+
+	rs.TickHandoffDeadline(big.NewInt(110))
+	if rs.pendingHandoff != nil {
+		t.Fatalf("expected pending handoff to be cleared after the deadline fallback, got %+v", rs.pendingHandoff)
+	}
+	if rs.stopValidatingBlock == nil || rs.stopValidatingBlock.Cmp(big.NewInt(100)) != 0 {
+		t.Fatalf("expected stopValidatingBlock to be set to the handoff's AtBlock, got %v", rs.stopValidatingBlock)
+	}
+
+	select {
+	case summary := <-ch:
+		if summary.StopValidatingBlock == nil || summary.StopValidatingBlock.Cmp(big.NewInt(100)) != 0 {
+			t.Fatalf("unexpected summary after deadline fallback: %+v", summary)
+		}
+	default:
+		t.Fatalf("expected a state-change notification after the deadline fallback")
+	}
+}
@@ -18,11 +18,14 @@ package replica
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"math/big"
 	"sync"
 
+	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/enode"
 	"github.com/ethereum/go-ethereum/rlp"
 	lvlerrors "github.com/syndtr/goleveldb/leveldb/errors"
 )
@@ -31,6 +34,13 @@ type State interface {
 	// mutation functions
 	SetStartValidatingBlock(blockNumber *big.Int) error
 	SetStopValidatingBlock(blockNumber *big.Int) error
+	AddValidatingRange(start, stop *big.Int) (uint64, error)
+	RemoveValidatingRange(id uint64) error
+	SetHandoffTransport(transport HandoffTransport)
+	RequestHandoff(target enode.ID, atBlock *big.Int) error
+	AcceptHandoff(peer enode.ID, atBlock *big.Int, head *big.Int) error
+	HandleHandoffMessage(sender enode.ID, raw []byte, localHead *big.Int) error
+	TickHandoffDeadline(seq *big.Int)
 	ShouldStartCore(seq *big.Int) bool
 	ShouldStopCore(seq *big.Int) bool
 	MakeReplica()
@@ -39,7 +49,19 @@ type State interface {
 
 	// view functions
 	IsPrimaryForSeq(seq *big.Int) bool
+	ListValidatingRanges() []ValidatingRange
+	PendingHandoff() *PendingHandoff
 	Summary() *ReplicaStateSummary
+	SubscribeStateChange(ch chan<- ReplicaStateSummary) event.Subscription
+}
+
+// ValidatingRange is a scheduled [Start, Stop) window of block numbers during
+// which this node should act as the primary validator. ID is assigned by
+// AddValidatingRange and is used to remove a range with RemoveValidatingRange.
+type ValidatingRange struct {
+	ID    uint64
+	Start *big.Int
+	Stop  *big.Int
 }
 
 // ReplicaState stores info on this node being a primary or replica
@@ -49,6 +71,27 @@ type replicaStateImpl struct {
 	startValidatingBlock *big.Int
 	stopValidatingBlock  *big.Int
 
+	// validatingRanges holds additional, independently scheduled primary
+	// windows on top of the legacy start/stop block pair above. It is kept
+	// ordered by Start and non-overlapping.
+	validatingRanges []ValidatingRange
+	nextRangeID      uint64
+
+	// pendingHandoff tracks an in-flight primary<->replica handoff
+	// negotiation, on whichever side of the handoff this node is playing.
+	// See handoff.go.
+	pendingHandoff *PendingHandoff
+
+	// transport signs and gossips handoff messages; nil until
+	// SetHandoffTransport is called by the backend.
+	transport HandoffTransport
+
+	// feed notifies SubscribeStateChange subscribers after the mutating
+	// methods listed on SubscribeStateChange and the handoff methods in
+	// handoff.go. AddValidatingRange, RemoveValidatingRange and the pruning
+	// of expired ranges change validatingRanges without notifying.
+	feed event.Feed
+
 	rsdb *ReplicaStateDB
 	mu   *sync.RWMutex
 }
@@ -67,6 +110,10 @@ func NewState(isReplica bool, path string) State {
 		}
 	} else if err != nil {
 		log.Warn("Can't read ReplicaStateDB at startup", "err", err, "dbpath", path)
+		rs = &replicaStateImpl{
+			isReplica: isReplica,
+			mu:        new(sync.RWMutex),
+		}
 	}
 	rs.rsdb = db
 	db.StoreReplicaState(rs)
@@ -83,9 +130,28 @@ func (rs *replicaStateImpl) Close() error {
 // SetStartValidatingBlock sets the start block in the range [start, stop)
 func (rs *replicaStateImpl) SetStartValidatingBlock(blockNumber *big.Int) error {
 	rs.mu.Lock()
-	defer rs.mu.Unlock()
-	defer rs.rsdb.StoreReplicaState(rs)
+	err := rs.setStartValidatingBlockLocked(blockNumber)
+	if err != nil {
+		rs.mu.Unlock()
+		return err
+	}
+	rs.rsdb.StoreReplicaState(rs)
+	summary := rs.summaryLocked()
+	rs.mu.Unlock()
 
+	rs.feed.Send(*summary)
+	return nil
+}
+
+// setStartValidatingBlockLocked is the body of SetStartValidatingBlock,
+// also used directly by the handoff protocol in handoff.go. The caller
+// must hold rs.mu and is responsible for persisting the state and, once
+// it has released rs.mu, sending the post-mutation Summary() to
+// SubscribeStateChange subscribers. It deliberately does not call
+// rs.feed.Send itself: that would block the lock on slow subscribers,
+// stalling every other caller including the per-block ShouldStartCore/
+// ShouldStopCore hot path.
+func (rs *replicaStateImpl) setStartValidatingBlockLocked(blockNumber *big.Int) error {
 	if blockNumber == nil {
 		rs.startValidatingBlock = nil
 		return nil
@@ -103,9 +169,28 @@ func (rs *replicaStateImpl) SetStartValidatingBlock(blockNumber *big.Int) error
 // SetStopValidatingBlock sets the stop block in the range [start, stop)
 func (rs *replicaStateImpl) SetStopValidatingBlock(blockNumber *big.Int) error {
 	rs.mu.Lock()
-	defer rs.mu.Unlock()
-	defer rs.rsdb.StoreReplicaState(rs)
+	err := rs.setStopValidatingBlockLocked(blockNumber)
+	if err != nil {
+		rs.mu.Unlock()
+		return err
+	}
+	rs.rsdb.StoreReplicaState(rs)
+	summary := rs.summaryLocked()
+	rs.mu.Unlock()
 
+	rs.feed.Send(*summary)
+	return nil
+}
+
+// setStopValidatingBlockLocked is the body of SetStopValidatingBlock, also
+// used directly by the handoff protocol in handoff.go. The caller must
+// hold rs.mu and is responsible for persisting the state and, once it has
+// released rs.mu, sending the post-mutation Summary() to
+// SubscribeStateChange subscribers. It deliberately does not call
+// rs.feed.Send itself: that would block the lock on slow subscribers,
+// stalling every other caller including the per-block ShouldStartCore/
+// ShouldStopCore hot path.
+func (rs *replicaStateImpl) setStopValidatingBlockLocked(blockNumber *big.Int) error {
 	if blockNumber == nil {
 		rs.stopValidatingBlock = nil
 		return nil
@@ -120,66 +205,171 @@ func (rs *replicaStateImpl) SetStopValidatingBlock(blockNumber *big.Int) error {
 	return nil
 }
 
-// MakeReplica makes this node a replica & clears all start/stop blocks.
-func (rs *replicaStateImpl) MakeReplica() {
+// AddValidatingRange schedules a new [start, stop) primary window. The range
+// must not overlap any range already scheduled. It returns an id that can
+// later be passed to RemoveValidatingRange.
+func (rs *replicaStateImpl) AddValidatingRange(start, stop *big.Int) (uint64, error) {
 	rs.mu.Lock()
 	defer rs.mu.Unlock()
-	defer rs.rsdb.StoreReplicaState(rs)
 
+	if start == nil || stop == nil {
+		return 0, errors.New("start and stop block numbers must both be set")
+	}
+	if start.Cmp(stop) >= 0 {
+		return 0, errors.New("start block number should be less than the stop block number")
+	}
+
+	insertAt := len(rs.validatingRanges)
+	for i, r := range rs.validatingRanges {
+		if start.Cmp(r.Stop) < 0 && r.Start.Cmp(stop) < 0 {
+			return 0, fmt.Errorf("range [%s, %s) overlaps existing range [%s, %s) (id %d)", start, stop, r.Start, r.Stop, r.ID)
+		}
+		if stop.Cmp(r.Start) <= 0 {
+			insertAt = i
+			break
+		}
+	}
+
+	id := rs.nextRangeID
+	rs.nextRangeID++
+
+	ranges := make([]ValidatingRange, 0, len(rs.validatingRanges)+1)
+	ranges = append(ranges, rs.validatingRanges[:insertAt]...)
+	ranges = append(ranges, ValidatingRange{ID: id, Start: start, Stop: stop})
+	ranges = append(ranges, rs.validatingRanges[insertAt:]...)
+	rs.validatingRanges = ranges
+
+	rs.rsdb.StoreReplicaState(rs)
+	return id, nil
+}
+
+// RemoveValidatingRange removes a previously scheduled range by id. It
+// returns an error if no range with that id exists.
+func (rs *replicaStateImpl) RemoveValidatingRange(id uint64) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for i, r := range rs.validatingRanges {
+		if r.ID == id {
+			rs.validatingRanges = append(rs.validatingRanges[:i], rs.validatingRanges[i+1:]...)
+			rs.rsdb.StoreReplicaState(rs)
+			return nil
+		}
+	}
+	return fmt.Errorf("no validating range with id %d", id)
+}
+
+// ListValidatingRanges returns the ordered set of currently scheduled
+// validating ranges.
+func (rs *replicaStateImpl) ListValidatingRanges() []ValidatingRange {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	ranges := make([]ValidatingRange, len(rs.validatingRanges))
+	copy(ranges, rs.validatingRanges)
+	return ranges
+}
+
+// MakeReplica makes this node a replica & clears all start/stop blocks.
+func (rs *replicaStateImpl) MakeReplica() {
+	rs.mu.Lock()
 	rs.enabled = false
 	rs.startValidatingBlock = nil
 	rs.stopValidatingBlock = nil
 	rs.isReplica = true
+	rs.rsdb.StoreReplicaState(rs)
+	summary := rs.summaryLocked()
+	rs.mu.Unlock()
+
+	rs.feed.Send(*summary)
 }
 
 // MakePrimary makes this node a primary & clears all start/stop blocks.
 func (rs *replicaStateImpl) MakePrimary() {
 	rs.mu.Lock()
-	defer rs.mu.Unlock()
-	defer rs.rsdb.StoreReplicaState(rs)
-
 	rs.enabled = false
 	rs.startValidatingBlock = nil
 	rs.stopValidatingBlock = nil
 	rs.isReplica = false
+	rs.rsdb.StoreReplicaState(rs)
+	summary := rs.summaryLocked()
+	rs.mu.Unlock()
+
+	rs.feed.Send(*summary)
 }
 
 // ShouldStartCore returns true if the backend should start the istanbul core.
 // Also updates replica state if the core should start.
 func (rs *replicaStateImpl) ShouldStartCore(seq *big.Int) bool {
 	rs.mu.Lock()
-	defer rs.mu.Unlock()
-	if rs.isPrimaryForSeq(seq) && rs.isReplica {
-		defer rs.rsdb.StoreReplicaState(rs)
-
+	pruned := rs.pruneExpiredRanges(seq)
+	var summary *ReplicaStateSummary
+	started := rs.isPrimaryForSeq(seq) && rs.isReplica
+	if started {
 		if rs.shouldSwitchToPrimary(seq) {
 			rs.enabled = false
 			rs.startValidatingBlock = nil
 			rs.stopValidatingBlock = nil
 		}
 		rs.isReplica = false
-		return true
+		rs.rsdb.StoreReplicaState(rs)
+		summary = rs.summaryLocked()
+	} else if pruned {
+		rs.rsdb.StoreReplicaState(rs)
 	}
-	return false
+	rs.mu.Unlock()
+
+	if summary != nil {
+		rs.feed.Send(*summary)
+	}
+	return started
+}
+
+// pruneExpiredRanges removes validating ranges that have already ended as of
+// seq, i.e. whose Stop is <= seq, and reports whether anything was removed.
+// It is called on every ShouldStartCore/ShouldStopCore tick regardless of
+// whether that tick actually fires a primary/replica transition, since an
+// adjacent later range, or the legacy start/stop window, can keep a node on
+// one side of the transition straight through an earlier range's boundary.
+func (rs *replicaStateImpl) pruneExpiredRanges(seq *big.Int) bool {
+	live := rs.validatingRanges[:0]
+	pruned := false
+	for _, r := range rs.validatingRanges {
+		if r.Stop.Cmp(seq) > 0 {
+			live = append(live, r)
+		} else {
+			pruned = true
+		}
+	}
+	rs.validatingRanges = live
+	return pruned
 }
 
 // ShouldStopCore returns true if the backend should stop the istanbul core.
 // Also updates replica state if the core should stop.
 func (rs *replicaStateImpl) ShouldStopCore(seq *big.Int) bool {
 	rs.mu.Lock()
-	defer rs.mu.Unlock()
-	if !rs.isPrimaryForSeq(seq) && !rs.isReplica {
-		defer rs.rsdb.StoreReplicaState(rs)
-
+	pruned := rs.pruneExpiredRanges(seq)
+	var summary *ReplicaStateSummary
+	stopped := !rs.isPrimaryForSeq(seq) && !rs.isReplica
+	if stopped {
 		if rs.shouldSwitchToReplica(seq) {
 			rs.enabled = false
 			rs.startValidatingBlock = nil
 			rs.stopValidatingBlock = nil
 		}
 		rs.isReplica = true
-		return true
+		rs.rsdb.StoreReplicaState(rs)
+		summary = rs.summaryLocked()
+	} else if pruned {
+		rs.rsdb.StoreReplicaState(rs)
 	}
-	return false
+	rs.mu.Unlock()
+
+	if summary != nil {
+		rs.feed.Send(*summary)
+	}
+	return stopped
 }
 
 // IsPrimaryForSeq determines is this node is the primary validator.
@@ -193,12 +383,18 @@ func (rs *replicaStateImpl) IsPrimaryForSeq(seq *big.Int) bool {
 }
 
 func (rs *replicaStateImpl) shouldSwitchToPrimary(blockNumber *big.Int) bool {
-	if !rs.enabled {
-		return false
+	if rs.enabled {
+		// start <= seq w/ no stop -> primary
+		if rs.startValidatingBlock != nil && rs.startValidatingBlock.Cmp(blockNumber) <= 0 {
+			if rs.stopValidatingBlock == nil {
+				return true
+			}
+		}
 	}
-	// start <= seq w/ no stop -> primary
-	if rs.startValidatingBlock != nil && rs.startValidatingBlock.Cmp(blockNumber) <= 0 {
-		if rs.stopValidatingBlock == nil {
+
+	// entering any scheduled range also triggers the switch
+	for _, r := range rs.validatingRanges {
+		if r.Start.Cmp(blockNumber) <= 0 && blockNumber.Cmp(r.Stop) < 0 {
 			return true
 		}
 	}
@@ -206,13 +402,20 @@ func (rs *replicaStateImpl) shouldSwitchToPrimary(blockNumber *big.Int) bool {
 	return false
 }
 func (rs *replicaStateImpl) shouldSwitchToReplica(blockNumber *big.Int) bool {
-	if !rs.enabled {
-		return false
+	if rs.enabled {
+		// start <= stop < seq -> replica
+		if rs.stopValidatingBlock != nil && rs.stopValidatingBlock.Cmp(blockNumber) <= 0 {
+			return true
+		}
 	}
-	// start <= stop < seq -> replica
-	if rs.stopValidatingBlock != nil && rs.stopValidatingBlock.Cmp(blockNumber) <= 0 {
-		return true
+
+	// exiting any scheduled range also triggers the switch
+	for _, r := range rs.validatingRanges {
+		if r.Stop.Cmp(blockNumber) <= 0 {
+			return true
+		}
 	}
+
 	return false
 }
 
@@ -221,31 +424,48 @@ func (rs *replicaStateImpl) shouldSwitchToReplica(blockNumber *big.Int) bool {
 // determine if start <= seq < stop. If not enabled, check if this was
 // set up with replica mode.
 func (rs *replicaStateImpl) isPrimaryForSeq(seq *big.Int) bool {
-	if !rs.enabled {
-		return !rs.isReplica
+	if rs.enabled {
+		// Return start <= seq < stop with start/stop at +-inf if nil
+		if !(rs.startValidatingBlock != nil && seq.Cmp(rs.startValidatingBlock) < 0) &&
+			!(rs.stopValidatingBlock != nil && seq.Cmp(rs.stopValidatingBlock) >= 0) {
+			return true
+		}
 	}
-	// Return start <= seq < stop with start/stop at +-inf if nil
-	if rs.startValidatingBlock != nil && seq.Cmp(rs.startValidatingBlock) < 0 {
-		return false
+	for _, r := range rs.validatingRanges {
+		if r.Start.Cmp(seq) <= 0 && seq.Cmp(r.Stop) < 0 {
+			return true
+		}
 	}
-	if rs.stopValidatingBlock != nil && seq.Cmp(rs.stopValidatingBlock) >= 0 {
+	// validatingRanges are additive windows on top of the node's existing
+	// behavior, not an exclusive override like the legacy enabled flag: if
+	// seq isn't covered by any of them, fall back to the legacy enabled
+	// check (already handled above) or, absent that, the node's default
+	// replica/primary role.
+	if rs.enabled {
 		return false
 	}
-	return true
+	return !rs.isReplica
 }
 
 type ReplicaStateSummary struct {
-	State                string   `json:"state"`
-	Enabled              bool     `json:"enabled"`
-	IsReplica            bool     `json:"isReplica"`
-	StartValidatingBlock *big.Int `json:"startValidatingBlock"`
-	StopValidatingBlock  *big.Int `json:"stopValidatingBlock"`
+	Version              uint8             `json:"version"`
+	State                string            `json:"state"`
+	Enabled              bool              `json:"enabled"`
+	IsReplica            bool              `json:"isReplica"`
+	StartValidatingBlock *big.Int          `json:"startValidatingBlock"`
+	StopValidatingBlock  *big.Int          `json:"stopValidatingBlock"`
+	ValidatingRanges     []ValidatingRange `json:"validatingRanges"`
 }
 
 func (rs *replicaStateImpl) Summary() *ReplicaStateSummary {
 	rs.mu.RLock()
 	defer rs.mu.RUnlock()
+	return rs.summaryLocked()
+}
 
+// summaryLocked is the body of Summary. The caller must hold rs.mu (for
+// reading or writing).
+func (rs *replicaStateImpl) summaryLocked() *ReplicaStateSummary {
 	// String explanation of replica state
 	var state string
 	if rs.isReplica && !rs.enabled {
@@ -258,22 +478,114 @@ func (rs *replicaStateImpl) Summary() *ReplicaStateSummary {
 		state = "Primary in given range"
 	}
 
-	summary := &ReplicaStateSummary{
+	ranges := make([]ValidatingRange, len(rs.validatingRanges))
+	copy(ranges, rs.validatingRanges)
+
+	return &ReplicaStateSummary{
+		Version:              DBVersion,
 		State:                state,
 		IsReplica:            rs.isReplica,
 		Enabled:              rs.enabled,
 		StartValidatingBlock: rs.startValidatingBlock,
 		StopValidatingBlock:  rs.stopValidatingBlock,
+		ValidatingRanges:     ranges,
 	}
+}
 
-	return summary
+// SubscribeStateChange registers ch to receive a ReplicaStateSummary
+// whenever MakePrimary, MakeReplica, ShouldStartCore, ShouldStopCore, or
+// SetStartValidatingBlock/SetStopValidatingBlock actually mutate
+// observable state. This lets callers react to primary<->replica
+// transitions immediately instead of polling IsPrimaryForSeq.
+func (rs *replicaStateImpl) SubscribeStateChange(ch chan<- ReplicaStateSummary) event.Subscription {
+	return rs.feed.Subscribe(ch)
 }
 
-type replicaStateRLP struct {
+// DBVersion is the current replicaStateImpl RLP schema version, written as
+// the leading element of every newly encoded record. Bump it whenever
+// replicaStateRLPV<N> gains or changes fields, add a replicaStateRLPV<N+1>
+// with the new shape, and register an upgrade path for it below.
+const DBVersion uint8 = 1
+
+// replicaStateRLPV1 is the version-1 on-disk payload, written inside the
+// versioned envelope (see EncodeRLP/DecodeRLP). It is exactly the set of
+// fields replicaStateImpl has accumulated to date; a future field addition
+// should land in a new replicaStateRLPV2 rather than change this one, so
+// that version-1 records already on disk keep decoding correctly.
+type replicaStateRLPV1 struct {
 	IsReplica            bool
 	Enabled              bool
 	StartValidatingBlock *big.Int
 	StopValidatingBlock  *big.Int
+	ValidatingRanges     []ValidatingRange
+	NextRangeID          uint64
+	HasPendingHandoff    bool
+	PendingHandoffPeer   enode.ID
+	PendingHandoffAt     *big.Int
+	PendingHandoffBy     *big.Int
+}
+
+// replicaStateEnvelopeRLP is the outer, version-tagged record written for
+// every replicaStateImpl. Payload holds the raw RLP encoding of the
+// version-specific struct named by Version, decoded by replicaStateDecoders.
+type replicaStateEnvelopeRLP struct {
+	Version uint8
+	Payload rlp.RawValue
+}
+
+// replicaStateDecoders maps a schema Version to the function that decodes
+// its Payload into rs. OpenReplicaStateDB consults the same registry when
+// it reads an on-disk record, so that a record written by an older binary
+// is transparently upgraded (decoded under its original version, then
+// re-encoded under DBVersion) the first time it is loaded.
+var replicaStateDecoders = map[uint8]func(rs *replicaStateImpl, payload rlp.RawValue) error{
+	1: decodeReplicaStateV1,
+}
+
+// replicaStateRLPV0 is the original, pre-versioning on-disk shape: just the
+// legacy isReplica/enabled/start/stop fields, with none of the later
+// additions (ranges, handoff, ...). Genuinely old validator DBs, written
+// before any of this series landed, are bare records of this shape.
+type replicaStateRLPV0 struct {
+	IsReplica            bool
+	Enabled              bool
+	StartValidatingBlock *big.Int
+	StopValidatingBlock  *big.Int
+}
+
+func decodeReplicaStateV0(rs *replicaStateImpl, payload rlp.RawValue) error {
+	var data replicaStateRLPV0
+	if err := rlp.DecodeBytes(payload, &data); err != nil {
+		return err
+	}
+
+	rs.isReplica = data.IsReplica
+	rs.enabled = data.Enabled
+	rs.startValidatingBlock = data.StartValidatingBlock
+	rs.stopValidatingBlock = data.StopValidatingBlock
+	return nil
+}
+
+func decodeReplicaStateV1(rs *replicaStateImpl, payload rlp.RawValue) error {
+	var data replicaStateRLPV1
+	if err := rlp.DecodeBytes(payload, &data); err != nil {
+		return err
+	}
+
+	rs.isReplica = data.IsReplica
+	rs.enabled = data.Enabled
+	rs.startValidatingBlock = data.StartValidatingBlock
+	rs.stopValidatingBlock = data.StopValidatingBlock
+	rs.validatingRanges = data.ValidatingRanges
+	rs.nextRangeID = data.NextRangeID
+	if data.HasPendingHandoff {
+		rs.pendingHandoff = &PendingHandoff{
+			Peer:     data.PendingHandoffPeer,
+			AtBlock:  data.PendingHandoffAt,
+			Deadline: data.PendingHandoffBy,
+		}
+	}
+	return nil
 }
 
 // EncodeRLP should write the RLP encoding of its receiver to w.
@@ -285,30 +597,72 @@ type replicaStateRLP struct {
 // recommended to write only a single value but writing multiple
 // values or no value at all is also permitted.
 func (rs *replicaStateImpl) EncodeRLP(w io.Writer) error {
-	entry := replicaStateRLP{
+	entry := replicaStateRLPV1{
 		IsReplica:            rs.isReplica,
 		Enabled:              rs.enabled,
 		StartValidatingBlock: rs.startValidatingBlock,
 		StopValidatingBlock:  rs.stopValidatingBlock,
+		ValidatingRanges:     rs.validatingRanges,
+		NextRangeID:          rs.nextRangeID,
 	}
-	return rlp.Encode(w, entry)
+	if rs.pendingHandoff != nil {
+		entry.HasPendingHandoff = true
+		entry.PendingHandoffPeer = rs.pendingHandoff.Peer
+		entry.PendingHandoffAt = rs.pendingHandoff.AtBlock
+		entry.PendingHandoffBy = rs.pendingHandoff.Deadline
+	}
+
+	payload, err := rlp.EncodeToBytes(entry)
+	if err != nil {
+		return err
+	}
+	return rlp.Encode(w, replicaStateEnvelopeRLP{Version: DBVersion, Payload: payload})
 }
 
 // The DecodeRLP method should read one value from the given
 // Stream. It is not forbidden to read less or more, but it might
 // be confusing.
+//
+// Two bare (unversioned, un-enveloped) shapes can show up on disk from
+// before schema versioning existed, and DecodeRLP tells all three apart by
+// the number of top-level list elements:
+//   - 2 elements: the current [Version, Payload] envelope.
+//   - 4 elements: the original pre-series replicaStateRLPV0 shape
+//     (isReplica/enabled/start/stop only).
+//   - anything else: the replicaStateRLPV1 shape, written by intermediate
+//     binaries that had already grown the ranges/handoff fields but not
+//     yet the version envelope.
 func (rs *replicaStateImpl) DecodeRLP(stream *rlp.Stream) error {
-	var data replicaStateRLP
-	err := stream.Decode(&data)
+	raw, err := stream.Raw()
 	if err != nil {
 		return err
 	}
 
 	rs.mu = new(sync.RWMutex)
-	rs.isReplica = data.IsReplica
-	rs.enabled = data.Enabled
-	rs.startValidatingBlock = data.StartValidatingBlock
-	rs.stopValidatingBlock = data.StopValidatingBlock
 
-	return nil
+	content, _, err := rlp.SplitList(raw)
+	if err != nil {
+		return err
+	}
+	numElements, err := rlp.CountValues(content)
+	if err != nil {
+		return err
+	}
+
+	switch numElements {
+	case 2:
+		var env replicaStateEnvelopeRLP
+		if err := rlp.DecodeBytes(raw, &env); err != nil {
+			return err
+		}
+		decode, ok := replicaStateDecoders[env.Version]
+		if !ok {
+			return fmt.Errorf("replica state db: unknown schema version %d", env.Version)
+		}
+		return decode(rs, env.Payload)
+	case 4:
+		return decodeReplicaStateV0(rs, raw)
+	default:
+		return decodeReplicaStateV1(rs, raw)
+	}
 }